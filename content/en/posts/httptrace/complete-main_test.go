@@ -0,0 +1,1660 @@
+// The directory holds two main packages, so run the tests with
+//
+//	go test complete-main.go complete-main_test.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// runMain starts the test binary again to run the program.
+	if args, ok := os.LookupEnv("HI_TEST_MAIN_ARGS"); ok {
+		os.Args = append([]string{"hi"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(exitOK)
+	}
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// runMain runs the program with args in a child process and returns what it
+// wrote to stdout and stderr and its exit status.
+func runMain(t *testing.T, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "HI_TEST_MAIN_ARGS="+strings.Join(args, "\n"))
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	var exitErr *exec.ExitError
+	if err := cmd.Run(); err != nil && !errors.As(err, &exitErr) {
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), cmd.ProcessState.ExitCode()
+}
+
+// closedPort returns the address of a local port nothing listens on.
+func closedPort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return l.Addr().String()
+}
+
+// fakeClock returns a clock that starts at start and advances by step every
+// time it is read.
+func fakeClock(start time.Time, step time.Duration) func() time.Time {
+	now := start
+	return func() time.Time {
+		t := now
+		now = now.Add(step)
+		return t
+	}
+}
+
+// remoteConn is a net.Conn connected to the address remote.
+type remoteConn struct {
+	net.Conn
+	remote string
+}
+
+func (c remoteConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.remote)
+	return addr
+}
+
+func TestCallbacksReadTheInjectedClock(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := newStats()
+	s.now = fakeClock(start, time.Millisecond)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	s.getConn("example.com:443")
+	s.dnsStart(httptrace.DNSStartInfo{Host: "example.com"})
+	s.dnsDone(httptrace.DNSDoneInfo{})
+	s.connectStart("tcp", "192.0.2.1:443")
+	s.connectDone("tcp", "192.0.2.1:443", nil)
+	s.gotConn(httptrace.GotConnInfo{Conn: remoteConn{client, "192.0.2.1:443"}})
+	s.wroteHeaderField("Host", []string{"example.com"})
+	s.wroteHeaders()
+	s.wroteRequest(httptrace.WroteRequestInfo{})
+	s.gotFirstResponseByte()
+	s.putIdleConn(nil)
+
+	if !s.totalStartAt.Equal(start) {
+		t.Errorf("totalStartAt = %s, want %s", s.totalStartAt, start)
+	}
+	for _, tc := range []struct {
+		name string
+		got  time.Duration
+		want time.Duration
+	}{
+		{"dns", s.dnsTook, time.Millisecond},
+		{"connect", s.connTook, time.Millisecond},
+		{"send", s.sendTook, time.Millisecond},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s took %s, want %s", tc.name, tc.got, tc.want)
+		}
+	}
+	if s.totalTook <= s.ttfb() || s.ttfb() <= 0 {
+		t.Errorf("total %s and ttfb %s are not ordered", s.totalTook, s.ttfb())
+	}
+}
+
+func TestLimitRateThrottlesTheTransfer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("a"), 20000))
+	}))
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	s, err := measureAttempt(req, *srv.Client(), nil, 1, options{limitRate: 100000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 20000 bytes at 100000 bytes per second take 200ms.
+	if s.bytesReceived != 20000 || s.transferTook < 190*time.Millisecond || s.transferTook > time.Second {
+		t.Errorf("received %d bytes in %s, want 20000 in about 200ms", s.bytesReceived, s.transferTook)
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("hello"))
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	s, err := measureAttempt(req, *srv.Client(), nil, 1, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := newResult(s); r.Trailers["X-Checksum"] != "abc" {
+		t.Errorf("trailers = %v, want X-Checksum: abc", r.Trailers)
+	}
+	if s.trailerAt.Before(s.transferStartAt) {
+		t.Errorf("trailers arrived at %s, before the first byte at %s", s.trailerAt, s.transferStartAt)
+	}
+}
+
+func TestTTFBOnlySkipsTheTransfer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("a"), 500))
+	}))
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	for range 5 {
+		// A fresh transport for each run, so no dial of a previous run is
+		// still racing for the connection.
+		client := http.Client{Transport: &http.Transport{}}
+		s, err := measureAttempt(req, client, nil, 1, options{ttfbOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := newResult(s); !r.TransferSkipped || r.Transfer != 0 {
+			t.Errorf("transfer_skipped %t with transfer_ms %f", r.TransferSkipped, r.Transfer)
+		}
+	}
+}
+
+func TestTTFBOnlyStopsTheDownload(t *testing.T) {
+	const size = 256 << 20
+	written := make(chan int, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 32<<10)
+		n := 0
+		for n < size {
+			m, err := w.Write(chunk)
+			n += m
+			if err != nil {
+				break
+			}
+		}
+		written <- n
+	}))
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if _, err := measureAttempt(req, http.Client{Transport: &http.Transport{}}, nil, 1, options{ttfbOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-written:
+		if n >= size {
+			t.Errorf("server wrote the whole %d bytes body", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still writing the body after the client closed it")
+	}
+}
+
+func TestIdleTimeOfAReusedConnection(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	client := http.Client{Transport: &http.Transport{}}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if _, err := measureAttempt(req, client, nil, 1, options{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	s, err := measureAttempt(req, client, nil, 2, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.reused || s.idleTime < 100*time.Millisecond || s.idleTime > time.Second {
+		t.Errorf("reused %t after %s idle, want reused after about 100ms", s.reused, s.idleTime)
+	}
+}
+
+func TestSNI(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if hello.ServerName != "example.com" {
+				return nil, fmt.Errorf("unknown server name %q", hello.ServerName)
+			}
+			return nil, nil
+		},
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	for _, sni := range []string{"", "example.com"} {
+		transport := srv.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.ServerName = sni
+		_, err := measureAttempt(req, http.Client{Transport: transport}, nil, 1, options{})
+		if sni == "" && !errors.Is(err, errTLS) {
+			t.Errorf("without SNI: err = %v, want a TLS failure", err)
+		}
+		if sni != "" && err != nil {
+			t.Errorf("with SNI %q: %v", sni, err)
+		}
+	}
+}
+
+func TestTLSVersions(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	measureWith := func(minVersion uint16) (*stats, error) {
+		transport := srv.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.MinVersion = minVersion
+		return measureAttempt(req, http.Client{Transport: transport}, nil, 1, options{})
+	}
+
+	s, err := measureWith(tls.VersionTLS12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.tlsVersion != tls.VersionTLS12 {
+		t.Errorf("negotiated %s, want TLS 1.2", tls.VersionName(s.tlsVersion))
+	}
+
+	_, err = measureWith(tls.VersionTLS13)
+	if !errors.Is(err, errTLS) || !remoteAlert(err, alertProtocolVersion) {
+		t.Fatalf("err = %v, want a protocol version alert", err)
+	}
+	if msg := failureMessage(err, false, 0); !strings.Contains(msg, "none of the TLS versions") {
+		t.Errorf("message %q does not tell the versions apart", msg)
+	}
+}
+
+func TestCipherSuites(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	measureWith := func(suite uint16) (*stats, error) {
+		transport := srv.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.CipherSuites = []uint16{suite}
+		return measureAttempt(req, http.Client{Transport: transport}, nil, 1, options{})
+	}
+
+	s, err := measureWith(tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.cipherSuite != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("negotiated %s", tls.CipherSuiteName(s.cipherSuite))
+	}
+
+	_, err = measureWith(tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384)
+	if !errors.Is(err, errTLS) || !remoteAlert(err, alertHandshakeFailure) {
+		t.Fatalf("err = %v, want a handshake failure alert", err)
+	}
+	if msg := failureMessage(err, true, 0); !strings.Contains(msg, "no cipher suite in common") {
+		t.Errorf("message %q does not tell the cipher suites apart", msg)
+	}
+	if msg := failureMessage(errors.New("local error: tls: handshake failure"), true, 0); strings.Contains(msg, "cipher suite") {
+		t.Errorf("a local handshake failure was reported as %q", msg)
+	}
+}
+
+func TestInfluxExportsEveryRun(t *testing.T) {
+	lines := make(chan string, 1)
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lines <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		target string
+		code   int
+	}{
+		{srv.URL, exitOK},
+		{"http://" + closedPort(t), exitConnect},
+	} {
+		_, stderr, code := runMain(t, "-influx", influx.URL, "-influx-tag", "dc=eu", tc.target)
+		if code != tc.code {
+			t.Fatalf("%s: exit status %d, want %d\n%s", tc.target, code, tc.code, stderr)
+		}
+		select {
+		case line := <-lines:
+			u, _ := url.Parse(tc.target)
+			prefix := fmt.Sprintf("http_trace,dc=eu,host=%s,url=%s run=1i,dns_ms=", u.Hostname(), influxEscaper.Replace(tc.target))
+			if !strings.HasPrefix(line, prefix) || !strings.Contains(line, ",total_ms=") {
+				t.Errorf("%s: line %q, want it to start with %q", tc.target, line, prefix)
+			}
+		default:
+			t.Errorf("%s: no point written", tc.target)
+		}
+	}
+}
+
+// schemaKeys are the keys of the json format in schema version
+// resultSchemaVersion.
+var schemaKeys = []string{
+	"cipher_suite", "connect_ms", "connection", "dns_ms", "error", "failed_phase",
+	"idle_ms", "labels", "pre_write_ms", "proxy_connect_ms", "redirect_ms", "redirects",
+	"reused", "run", "schema_version", "send_ms", "server_timing", "setup_ms",
+	"tcp_handshake_ms", "timestamp", "tls_ms", "tls_version", "total_ms", "trailers",
+	"transfer_ms", "transfer_skipped", "ttfb_ms", "ttlb_ms", "wait_ms",
+}
+
+func TestJSONKeysMatchTheSchema(t *testing.T) {
+	if resultSchemaVersion != 12 {
+		t.Fatalf("schema version %d: update schemaKeys and this test", resultSchemaVersion)
+	}
+	s := newStats()
+	s.labels = map[string]string{"env": "prod"}
+	s.proxyTook = time.Millisecond
+	s.localAddr, s.remoteAddr = "127.0.0.1:1234", "127.0.0.1:443"
+	s.tlsVersion, s.cipherSuite = tls.VersionTLS13, tls.TLS_AES_128_GCM_SHA256
+	s.trailer = http.Header{"X-Checksum": {"abc"}}
+	s.serverTiming = []serverTiming{{Name: "db"}}
+	s.err, s.failedPhase = errors.New("boom"), "Wait"
+	var b bytes.Buffer
+	if err := reportJSON(&b, s); err != nil {
+		t.Fatal(err)
+	}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(b.Bytes(), &keys); err != nil {
+		t.Fatal(err)
+	}
+	got := slices.Sorted(maps.Keys(keys))
+	if !slices.Equal(got, schemaKeys) {
+		t.Errorf("keys %q, want %q", got, schemaKeys)
+	}
+}
+
+func TestParseHTTPFile(t *testing.T) {
+	file := `# a comment
+POST https://example.com/api?q=1
+Host: api.example.com
+Content-Type: application/json
+// another comment
+
+{"a": 1}
+### next request
+GET https://example.com/ignored
+`
+	req, err := parseHTTPFile(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != http.MethodPost || req.URL.String() != "https://example.com/api?q=1" {
+		t.Errorf("request line = %s %s", req.Method, req.URL)
+	}
+	if req.Host != "api.example.com" || req.Header.Get("Host") != "" {
+		t.Errorf("Host = %q, header %q", req.Host, req.Header.Get("Host"))
+	}
+	if got := req.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	body, _ := io.ReadAll(req.Body)
+	if string(body) != `{"a": 1}` {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestParseHTTPFileErrors(t *testing.T) {
+	for _, file := range []string{"", "# only a comment\n", "GET https://example.com\nnot a header\n"} {
+		if _, err := parseHTTPFile(strings.NewReader(file)); err == nil {
+			t.Errorf("parseHTTPFile(%q) succeeded", file)
+		}
+	}
+}
+
+func TestVarsAreSubstitutedIntoTheRequest(t *testing.T) {
+	paths := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.RequestURI()
+	}))
+	defer srv.Close()
+	if _, stderr, code := runMain(t, "-var", "id=42", srv.URL+"/users/{{ id }}?at={{timestamp}}"); code != exitOK {
+		t.Fatalf("exit status %d\n%s", code, stderr)
+	}
+	got := <-paths
+	if !regexp.MustCompile(`^/users/42\?at=\d+$`).MatchString(got) {
+		t.Errorf("server saw %q, want /users/42?at=<unix time>", got)
+	}
+	if got := expandVars("{{id}}-{{unknown}}", map[string]string{"id": "42"}); got != "42-{{unknown}}" {
+		t.Errorf("expandVars = %q, want the unknown placeholder kept", got)
+	}
+	if got := expandVars("{{uuid}}", nil); !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(got) {
+		t.Errorf("{{uuid}} expanded to %q", got)
+	}
+}
+
+func TestParseServerTiming(t *testing.T) {
+	got := parseServerTiming([]string{`db;dur=53.2;desc="Query, slow", cache;desc=hit`, "total;dur=70"})
+	want := []serverTiming{
+		{Name: "db", Duration: 53.2, Description: "Query, slow"},
+		{Name: "cache", Description: "hit"},
+		{Name: "total", Duration: 70},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("parseServerTiming = %v, want %v", got, want)
+	}
+}
+
+func TestFailedRunsRenderThePhasesReached(t *testing.T) {
+	names := []string{"DNS", "Connect", "TLS", "Send", "Wait", "Transfer"}
+	for i, failed := range names {
+		s := newStats()
+		s.dnsTook, s.connTook, s.tlsTook = time.Millisecond, time.Millisecond, time.Millisecond
+		s.sendTook, s.waitTook, s.transferTook = time.Millisecond, time.Millisecond, time.Millisecond
+		s.totalTook = 6 * time.Millisecond
+		s.failedPhase = failed
+		s.err = errors.New("boom")
+		var b bytes.Buffer
+		if err := reportText(&b, s); err != nil {
+			t.Fatal(err)
+		}
+		var values []string
+		for j := range names {
+			switch {
+			case j < i:
+				values = append(values, "1.000")
+			case j == i:
+				values = append(values, "failed")
+			default:
+				values = append(values, "-")
+			}
+		}
+		want := strings.Join(names, "\t") + "\tTotal\n" + strings.Join(values, "\t") + "\t6.000\n"
+		if !strings.Contains(b.String(), want) || !strings.Contains(b.String(), "Request failed: boom\n") {
+			t.Errorf("failed %s phase rendered as:\n%s\nwant:\n%s", failed, b.String(), want)
+		}
+	}
+}
+
+func TestDumpCerts(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	dir := t.TempDir()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if _, err := measureAttempt(req, *srv.Client(), nil, 1, options{certsDir: dir}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "0.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		t.Fatalf("0.pem holds no certificate:\n%s", data)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Equal(srv.Certificate()) {
+		t.Errorf("dumped %q, want the server certificate %q", cert.Subject, srv.Certificate().Subject)
+	}
+}
+
+// measuredStats returns stats as left by a successful request.
+func measuredStats() *stats {
+	s := newStats()
+	s.firstStartAt = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.totalStartAt = s.firstStartAt
+	s.labels = map[string]string{"env": "prod"}
+	s.dnsTook = 2 * time.Millisecond
+	s.connTook = 3 * time.Millisecond
+	s.totalTook = 10 * time.Millisecond
+	s.status = 200
+	s.bytesReceived = 42
+	return s
+}
+
+// checkReport fails t unless the output of the format for s holds every one
+// of want.
+func checkReport(t *testing.T, format string, s *stats, want ...string) {
+	t.Helper()
+	var b bytes.Buffer
+	if err := reporters[format].report(&b, s); err != nil {
+		t.Fatalf("%s: %v", format, err)
+	}
+	for _, w := range want {
+		if !strings.Contains(b.String(), w) {
+			t.Errorf("%s output %q lacks %q", format, b.String(), w)
+		}
+	}
+}
+
+func TestTextReportsTheRun(t *testing.T) {
+	checkReport(t, "text", measuredStats(), "Run 1 started at 2024-01-02T03:04:05Z\n", "Labels: env=prod\n")
+}
+
+func TestTimestampIsTheStartOfTheRun(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		http.Redirect(w, r, "/b", http.StatusFound)
+	})
+	mux.HandleFunc("/b", func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	client := *srv.Client()
+	client.CheckRedirect = checkRedirect
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/a", nil)
+	s, err := measureAttempt(req, client, nil, 1, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := newResult(s); !r.Timestamp.Equal(s.firstStartAt) || s.totalStartAt.Sub(r.Timestamp) < 50*time.Millisecond {
+		t.Errorf("timestamp %s, want the start of the first hop %s, not the last one %s", r.Timestamp, s.firstStartAt, s.totalStartAt)
+	}
+
+	path := filepath.Join(t.TempDir(), "report.html")
+	if err := writeHTML(path, []string{req.URL.String()}, []*stats{s}); err != nil {
+		t.Fatal(err)
+	}
+	page, _ := os.ReadFile(path)
+	var want strings.Builder
+	template.Must(template.New("").Parse("Run 1 started at {{.}}")).Execute(&want, s.firstStartAt.Format(time.RFC3339Nano))
+	if !strings.Contains(string(page), want.String()) {
+		t.Errorf("html report lacks %q", want.String())
+	}
+}
+
+func TestStatsContextRoundTrip(t *testing.T) {
+	if s := statsFromContext(context.Background()); s != nil {
+		t.Errorf("stats %p found in an empty context", s)
+	}
+	var got *stats
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	client := *srv.Client()
+	client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		got = statsFromContext(req.Context())
+		return srv.Client().Transport.RoundTrip(req)
+	})
+	ctx, s := withStats(context.Background())
+	if httptrace.ContextClientTrace(ctx) == nil {
+		t.Error("withStats did not trace the context")
+	}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got != s {
+		t.Errorf("the transport got stats %p, want %p", got, s)
+	}
+	if s.totalStartAt.IsZero() || s.waitTook <= 0 {
+		t.Error("the trace in the context did not time the request")
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestTCPConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	if _, err := tcpConnect(addr, time.Second); err != nil {
+		t.Errorf("open port: %v", err)
+	}
+	l.Close()
+	_, err = tcpConnect(addr, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("closed port: err = %v, want connection refused", err)
+	}
+	if got := exitCode(phaseError("Connect", err)); got != exitConnect {
+		t.Errorf("closed port exits %d, want %d", got, exitConnect)
+	}
+}
+
+func TestCSVHonorsUnitAndPrecision(t *testing.T) {
+	defer func(f durationFormat) { durations = f }(durations)
+	for _, tc := range []struct {
+		f    durationFormat
+		want string
+	}{
+		{durationFormat{unit: "ms", precision: 3}, "run,timestamp,dns_ms,connect_ms,tls_ms,send_ms,wait_ms,transfer_ms,total_ms,status,bytes_sent,bytes_received,labels\n" +
+			"1,2024-01-02T03:04:05Z,2.000,3.000,0.000,0.000,0.000,0.000,10.000,200,0,42,env=prod\n"},
+		{durationFormat{unit: "us", precision: 0}, "run,timestamp,dns_us,connect_us,tls_us,send_us,wait_us,transfer_us,total_us,status,bytes_sent,bytes_received,labels\n" +
+			"1,2024-01-02T03:04:05Z,2000,3000,0,0,0,0,10000,200,0,42,env=prod\n"},
+	} {
+		durations = tc.f
+		var b bytes.Buffer
+		if err := reportCSV(&b, measuredStats()); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tc.want {
+			t.Errorf("csv in %s:\n%s\nwant:\n%s", tc.f.unit, b.String(), tc.want)
+		}
+	}
+}
+
+func TestDelimitedFormats(t *testing.T) {
+	checkReport(t, "csv", measuredStats(), "run,timestamp,dns_ms,", "\n1,2024-01-02T03:04:05Z,2.000,3.000,")
+	checkReport(t, "tsv", measuredStats(), "run\ttimestamp\tdns_ms\t", "\n1\t2024-01-02T03:04:05Z\t2.000\t3.000\t")
+}
+
+func TestNormalizeTarget(t *testing.T) {
+	for _, tc := range []struct {
+		target, scheme, want string
+	}{
+		{"example.com", "", "https://example.com"},
+		{"example.com:8443/path", "", "https://example.com:8443/path"},
+		{"example.com:8080", "", "http://example.com:8080"},
+		{"example.com:9000", "http", "http://example.com:9000"},
+		{"http://example.com:9000/x", "", "http://example.com:9000/x"},
+		{"host:8080/?next=http://x", "", "http://host:8080/?next=http://x"},
+		{"[fe80::1%eth0]:80", "", "http://[fe80::1%25eth0]:80"},
+	} {
+		got, err := normalizeTarget(tc.target, tc.scheme)
+		if err != nil || got != tc.want {
+			t.Errorf("normalizeTarget(%q, %q) = %q, %v, want %q", tc.target, tc.scheme, got, err, tc.want)
+		}
+	}
+	if _, err := normalizeTarget("example.com:9000/?u=https://x", ""); err == nil {
+		t.Error("the scheme of an unknown port was inferred")
+	}
+}
+
+// failures are the kinds of failure measureFailure causes, with the error
+// measure returns wrapping and the exit status reporting them.
+var failures = []struct {
+	kind string
+	want error
+	code int
+}{
+	{"dns", errDNS, exitDNS},
+	{"connect", errConnect, exitConnect},
+	{"tls", errTLS, exitTLS},
+	{"timeout", errTimeout, exitTimeout},
+	{"transfer", errTransfer, exitTransfer},
+}
+
+// measureFailure measures a request failing as kind says and returns the
+// error of measure.
+func measureFailure(t *testing.T, kind string) error {
+	t.Helper()
+	client, target, opts := http.Client{}, "", options{}
+	switch kind {
+	case "dns":
+		target = "http://does-not-exist.invalid/"
+	case "connect":
+		target = "http://" + closedPort(t)
+	case "tls":
+		// The client does not trust the certificate of the test server.
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		t.Cleanup(srv.Close)
+		target = srv.URL
+	case "timeout":
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		t.Cleanup(srv.Close)
+		target, opts.budget = srv.URL, 50*time.Millisecond
+	case "transfer":
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "1000")
+			w.Write([]byte("truncated"))
+			conn, _, _ := http.NewResponseController(w).Hijack()
+			conn.Close()
+		}))
+		t.Cleanup(srv.Close)
+		target = srv.URL
+	default:
+		t.Fatalf("unknown failure %q", kind)
+	}
+	client.Transport = &http.Transport{}
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+	_, err := measureAttempt(req, client, nil, 1, opts)
+	return err
+}
+
+func TestFailuresWrapThePhaseError(t *testing.T) {
+	for _, f := range failures {
+		if err := measureFailure(t, f.kind); !errors.Is(err, f.want) {
+			t.Errorf("%s failure: err = %v, want it to wrap %v", f.kind, err, f.want)
+		}
+	}
+}
+
+func TestNoBody(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/range", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(strings.Repeat("a", 1000)))
+	})
+	mux.HandleFunc("/full", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("a", 1000))
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Method+" "+r.Header.Get("Range"))
+		mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	for _, tc := range []struct {
+		path     string
+		status   int
+		received int64
+		by       string
+		seen     []string
+	}{
+		{"/range", http.StatusPartialContent, 1, "range", []string{"GET bytes=0-0"}},
+		{"/full", http.StatusOK, 0, http.MethodHead, []string{"GET bytes=0-0", "HEAD "}},
+	} {
+		seen = nil
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+tc.path, nil)
+		s, err := measureAttempt(req, *srv.Client(), nil, 1, options{noBody: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.status != tc.status || s.bytesReceived != tc.received || s.bodySkippedBy != tc.by {
+			t.Errorf("%s: status %d, %d bytes, skipped by %q, want %d, %d bytes, skipped by %q",
+				tc.path, s.status, s.bytesReceived, s.bodySkippedBy, tc.status, tc.received, tc.by)
+		}
+		mu.Lock()
+		if !slices.Equal(seen, tc.seen) {
+			t.Errorf("%s: server saw %q, want %q", tc.path, seen, tc.seen)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestIdleTimeoutClosesTheConnection(t *testing.T) {
+	var mu sync.Mutex
+	count := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if count++; count == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	for _, tc := range []struct {
+		idleTimeout string
+		reused      bool
+	}{
+		{"50ms", false},
+		{"1m", true},
+	} {
+		mu.Lock()
+		count = 0
+		mu.Unlock()
+		stdout, stderr, code := runMain(t, "-until-status", "200", "-interval", "200ms", "-idle-timeout", tc.idleTimeout, "-format", "json", srv.URL)
+		if code != exitOK {
+			t.Fatalf("exit status %d\n%s", code, stderr)
+		}
+		var r result
+		if err := json.Unmarshal([]byte(stdout), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Run != 2 || r.Reused != tc.reused {
+			t.Errorf("-idle-timeout %s: run %d reused %t, want run 2 reused %t", tc.idleTimeout, r.Run, r.Reused, tc.reused)
+		}
+		if closed := strings.Contains(stderr, "idle connection closed after -idle-timeout"); closed == tc.reused {
+			t.Errorf("-idle-timeout %s: closing the connection reported %t", tc.idleTimeout, closed)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	timeout := &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{nil, exitOK},
+		{errors.New("boom"), exitFailure},
+		{phaseError("DNS", errors.New("no such host")), exitDNS},
+		{phaseError("Connect", errors.New("refused")), exitConnect},
+		{phaseError("TLS", errors.New("bad certificate")), exitTLS},
+		{phaseError("Transfer", errors.New("reset")), exitTransfer},
+		{phaseError("Connect", timeout), exitTimeout},
+		{phaseError("Wait", context.DeadlineExceeded), exitTimeout},
+	} {
+		if got := exitCode(tc.err); got != tc.want {
+			t.Errorf("exitCode(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestExitCodeOfRealFailures(t *testing.T) {
+	for _, f := range failures {
+		if got := exitCode(measureFailure(t, f.kind)); got != f.code {
+			t.Errorf("%s failure exits %d, want %d", f.kind, got, f.code)
+		}
+	}
+}
+
+func TestExitStatusOfTheProgram(t *testing.T) {
+	target := "http://" + closedPort(t)
+	for _, tc := range []struct {
+		args []string
+		code int
+		want string
+	}{
+		{[]string{"-unit", "bogus", target}, exitUsage, `unknown unit "bogus"`},
+		{[]string{"-format", "nope", target}, exitUsage, `unknown format "nope"`},
+		{[]string{"-tls-min", "9", target}, exitUsage, `-tls-min: unknown TLS version "9"`},
+		{[]string{"-only", "foo", target}, exitUsage, `unknown metric "foo"`},
+		{[]string{"example.com:9000"}, exitUsage, "cannot infer the scheme"},
+		{[]string{"-no-such-flag", target}, exitUsage, "flag provided but not defined"},
+		{[]string{target}, exitConnect, "connection refused"},
+		{[]string{"-streams", "2", target}, exitConnect, "connection refused"},
+		{[]string{"-tcp-only", target}, exitConnect, "connection refused"},
+		{[]string{"-file", filepath.Join(t.TempDir(), "missing.http")}, exitFailure, "no such file"},
+	} {
+		_, stderr, code := runMain(t, tc.args...)
+		if code != tc.code || !strings.Contains(stderr, tc.want) {
+			t.Errorf("%q: exit status %d, want %d with %q\n%s", tc.args, code, tc.code, tc.want, stderr)
+		}
+		if reason := fmt.Sprintf("exiting with status %d: %s\n", tc.code, exitReasons[tc.code]); !strings.Contains(stderr, reason) {
+			t.Errorf("%q: stderr lacks %q", tc.args, reason)
+		}
+	}
+}
+
+func TestUntilStatus(t *testing.T) {
+	var mu sync.Mutex
+	count := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if count++; count <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	for _, tc := range []struct {
+		maxAttempts string
+		code        int
+		want        string
+	}{
+		{"10", exitOK, "condition met after 3 attempts"},
+		{"2", exitFailure, "condition not met after 2 attempts"},
+	} {
+		mu.Lock()
+		count = 0
+		mu.Unlock()
+		stdout, stderr, code := runMain(t, "-until-status", "200", "-interval", "10ms", "-max-attempts", tc.maxAttempts, "-format", "json", srv.URL)
+		if code != tc.code || !strings.Contains(stderr, tc.want) {
+			t.Fatalf("-max-attempts %s: exit status %d, want %d with %q\n%s", tc.maxAttempts, code, tc.code, tc.want, stderr)
+		}
+		var r result
+		if err := json.Unmarshal([]byte(stdout), &r); err != nil {
+			t.Fatal(err)
+		}
+		if tc.code == exitOK && r.Run != 3 {
+			t.Errorf("reported run %d, want the third one", r.Run)
+		}
+	}
+}
+
+func TestParseCookieFile(t *testing.T) {
+	file := "# Netscape HTTP Cookie File\n" +
+		"example.com\tFALSE\t/\tFALSE\t0\tsession\tabc\n" +
+		"#HttpOnly_.example.org\tTRUE\t/\tTRUE\t4102444800\ttoken\txyz\n"
+	jar, _ := cookiejar.New(nil)
+	if err := parseCookieFile(strings.NewReader(file), jar); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		url  string
+		want string
+	}{
+		{"http://example.com/", "session=abc"},
+		{"https://www.example.org/", "token=xyz"},
+		{"http://www.example.org/", ""},
+	} {
+		u, _ := url.Parse(tc.url)
+		var got []string
+		for _, c := range jar.Cookies(u) {
+			got = append(got, c.Name+"="+c.Value)
+		}
+		if strings.Join(got, "; ") != tc.want {
+			t.Errorf("cookies of %s = %q, want %q", tc.url, got, tc.want)
+		}
+	}
+	if err := parseCookieFile(strings.NewReader("example.com\tFALSE\t/\n"), jar); err == nil {
+		t.Error("a line with 3 fields was accepted")
+	}
+}
+
+func TestRedirectHopsDoNotLeakIntoTheFinalRequest(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		http.Redirect(w, r, "/b", http.StatusFound)
+	})
+	mux.HandleFunc("/b", func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewTLSServer(mux)
+	defer srv.Close()
+	client := *srv.Client()
+	client.CheckRedirect = checkRedirect
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/a", nil)
+	s, err := measureAttempt(req, client, nil, 1, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.redirects != 1 || !s.reused {
+		t.Fatalf("%d redirects, reused %t, want the second hop on the connection of the first", s.redirects, s.reused)
+	}
+	r := newResult(s)
+	if r.DNS != 0 || r.Connect != 0 || r.TLS != 0 || r.Setup != 0 {
+		t.Errorf("reused connection reports dns %fms, connect %fms, tls %fms, setup %fms of the first hop", r.DNS, r.Connect, r.TLS, r.Setup)
+	}
+	if s.redirectTook < 50*time.Millisecond || s.totalTook >= s.redirectTook {
+		t.Errorf("redirects took %s and the final request %s, want the 50ms of the first hop in the redirects only", s.redirectTook, s.totalTook)
+	}
+}
+
+func TestOversizedHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Big", strings.Repeat("a", 4096))
+	}))
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	_, err := measureAttempt(req, http.Client{Transport: &http.Transport{MaxResponseHeaderBytes: 1024}}, nil, 1, options{})
+	if err == nil {
+		t.Fatal("4KB of headers accepted with a limit of 1KB")
+	}
+	want := "response headers exceeded 1024 bytes, raise -max-header-bytes to accept them"
+	if msg := failureMessage(err, false, 1024); msg != want {
+		t.Errorf("message %q, want %q", msg, want)
+	}
+	if msg := failureMessage(err, false, 0); !strings.Contains(msg, fmt.Sprintf("exceeded %d bytes", defaultMaxResponseHeaderBytes)) {
+		t.Errorf("message %q does not give the default limit", msg)
+	}
+}
+
+func TestLogfmt(t *testing.T) {
+	checkReport(t, "logfmt", measuredStats(), "run=1 ", "timestamp=2024-01-02T03:04:05Z ", "dns_ms=2.000", "status=200", "bytes=42", "label_env=prod")
+}
+
+// connectProxy is a handler tunneling CONNECT requests to their target.
+func connectProxy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go io.Copy(target, rw)
+	io.Copy(conn, target)
+}
+
+func TestProxyConnect(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(connectProxy))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	transport.OnProxyConnectResponse = proxyConnectResponse
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	s, err := measureAttempt(req, http.Client{Transport: transport}, nil, 1, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.proxyTook <= 0 || s.connTook <= 0 || s.tlsTook <= 0 {
+		t.Errorf("proxy CONNECT %s, connect %s, TLS %s, want all measured", s.proxyTook, s.connTook, s.tlsTook)
+	}
+	if s.remoteAddr != proxyURL.Host {
+		t.Errorf("connected to %s, want the proxy at %s", s.remoteAddr, proxyURL.Host)
+	}
+}
+
+func TestWebSocketUpgrade(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+			http.Error(w, "not a WebSocket upgrade", http.StatusBadRequest)
+			return
+		}
+		sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		if r.URL.Query().Has("bad-accept") {
+			sum = [sha1.Size]byte{}
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+		rw.Flush()
+	}))
+	defer srv.Close()
+	for _, tc := range []struct {
+		query string
+		err   string
+	}{
+		{"", ""},
+		{"?bad-accept", "invalid Sec-WebSocket-Accept"},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+tc.query, nil)
+		s, err := measureAttempt(req, http.Client{Transport: &http.Transport{}}, nil, 1, options{webSocket: true})
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%q: err = %v, want %q", tc.query, err, tc.err)
+		}
+		if s.status != http.StatusSwitchingProtocols || !s.transferSkipped || s.totalTook <= 0 {
+			t.Errorf("%q: status %d, transfer skipped %t, total %s, want the handshake timed through the 101", tc.query, s.status, s.transferSkipped, s.totalTook)
+		}
+	}
+}
+
+func TestOnlyPrintsASingleValue(t *testing.T) {
+	s := measuredStats()
+	s.transferTook = 4 * time.Millisecond
+	s.transferSkipped = true
+	for metric, want := range map[string]string{
+		"dns":      "2.000\n",
+		"connect":  "3.000\n",
+		"total":    "10.000\n",
+		"setup":    "5.000\n",
+		"transfer": "0.000\n",
+	} {
+		var b bytes.Buffer
+		if err := reportMetric(metric).report(&b, s); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != want {
+			t.Errorf("-only %s printed %q, want %q", metric, b.String(), want)
+		}
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cookie", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie("session"); err != nil {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1"})
+			http.Redirect(w, r, "/cookie", http.StatusFound)
+		}
+	})
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/b", http.StatusFound) })
+	mux.HandleFunc("/b", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/a", http.StatusFound) })
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	client := *srv.Client()
+	client.CheckRedirect = checkRedirect
+	client.Jar, _ = cookiejar.New(nil)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/cookie", nil)
+	s, err := measureAttempt(req, client, nil, 1, options{})
+	if err != nil {
+		t.Fatalf("redirect to self after setting a cookie: %v", err)
+	}
+	if s.redirects != 1 {
+		t.Errorf("redirects = %d, want 1", s.redirects)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/a", nil)
+	_, err = measureAttempt(req, client, nil, 1, options{})
+	want := fmt.Sprintf("redirect loop detected: %[1]s/a -> %[1]s/b -> %[1]s/a", srv.URL)
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("loop error = %v, want %q", err, want)
+	}
+}
+
+func TestHappyEyeballsLoserDoesNotFailTheConnect(t *testing.T) {
+	s := newStats()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	s.getConn("example.com:443")
+	s.connectStart("tcp", "[2001:db8::1]:443")
+	s.connectStart("tcp", "192.0.2.1:443")
+	time.Sleep(time.Millisecond)
+	s.connectDone("tcp", "192.0.2.1:443", nil)
+	// The loser gives up while the winner is in use.
+	lost := make(chan struct{})
+	go func() {
+		s.connectDone("tcp", "[2001:db8::1]:443", errors.New("operation was canceled"))
+		close(lost)
+	}()
+	s.gotConn(httptrace.GotConnInfo{Conn: remoteConn{client, "192.0.2.1:443"}})
+	s.tlsStart()
+	s.tlsDone(tls.ConnectionState{}, nil)
+	<-lost
+
+	s.dialsMu.Lock()
+	defer s.dialsMu.Unlock()
+	if s.failedPhase != "" {
+		t.Errorf("failed phase %q after the loser gave up", s.failedPhase)
+	}
+	if winner := s.dials[1]; s.connTook != winner.took || s.connTook < time.Millisecond {
+		t.Errorf("connect took %s, want the %s of the winner", s.connTook, winner.took)
+	}
+}
+
+// fakeNameserver returns the address of a local DNS server, which answers
+// every query with rcode and the addresses of ips of the family asked.
+func fakeNameserver(t *testing.T, rcode byte, ips ...net.IP) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(dnsResponse(buf[:n], rcode, ips), addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// fakeResolver returns a resolver asking a fakeNameserver.
+func fakeResolver(t *testing.T, rcode byte, ips ...net.IP) *net.Resolver {
+	t.Helper()
+	addr := fakeNameserver(t, rcode, ips...)
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", addr)
+		},
+	}
+}
+
+// dnsResponse returns the response to the DNS query q, with rcode and the
+// addresses of ips matching the type of the question as answers.
+func dnsResponse(q []byte, rcode byte, ips []net.IP) []byte {
+	// The question follows the 12 bytes of the header; its name ends with
+	// an empty label and is followed by the type and class.
+	end := 12
+	for q[end] != 0 {
+		end += int(q[end]) + 1
+	}
+	end += 5
+	qtype := binary.BigEndian.Uint16(q[end-4:])
+	resp := append([]byte{}, q[:end]...)
+	resp[2] = 0x84 | q[2]&0x01 // response, authoritative, recursion desired
+	resp[3] = 0x80 | rcode     // recursion available
+	clear(resp[6:12])
+	answers := 0
+	for _, ip := range ips {
+		data := ip.To4()
+		switch {
+		case qtype == 1 && data != nil:
+		case qtype == 28 && data == nil:
+			data = ip.To16()
+		default:
+			continue
+		}
+		// The name points to the one of the question.
+		resp = append(resp, 0xc0, 12, byte(qtype>>8), byte(qtype), 0, 1, 0, 0, 0, 60, 0, byte(len(data)))
+		resp = append(resp, data...)
+		answers++
+	}
+	binary.BigEndian.PutUint16(resp[6:], uint16(answers))
+	return resp
+}
+
+func TestHappyEyeballsWinnerIsReported(t *testing.T) {
+	// Only IPv4 listens, so the IPv6 attempt Happy Eyeballs starts with
+	// is refused and the IPv4 one wins.
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &httptest.Server{Listener: l, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}}
+	srv.Start()
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	dialer := &net.Dialer{Resolver: fakeResolver(t, 0, net.ParseIP("127.0.0.1"), net.IPv6loopback), ControlContext: markHandshakeStart}
+	client := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+	req, _ := http.NewRequest(http.MethodGet, "http://dual-stack.test:"+port, nil)
+	s, err := measureAttempt(req, client, nil, 1, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	reportText(&b, s)
+	for _, want := range []string{
+		"IPv6 connect to [::1]:" + port + " failed after ",
+		"IPv4 connect to 127.0.0.1:" + port + " won after " + durations.format(s.connTook) + "ms\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, b.String())
+		}
+	}
+	if s.failedPhase != "" {
+		t.Errorf("failed phase %q after the IPv4 attempt won", s.failedPhase)
+	}
+}
+
+func TestRawRequestIsSentVerbatim(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Method + " " + r.RequestURI + " " + r.Header.Get("X-Odd")
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	data := []byte("GET /path?q=1 HTTP/1.1\r\nHost: x\r\nX-Odd:  spaced  \r\nConnection: close\r\n\r\n")
+	s, err := measureRaw(u, data, &http.Transport{DialContext: (&net.Dialer{}).DialContext}, nil, 1, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "GET /path?q=1 spaced" {
+		t.Errorf("server saw %q", got)
+	}
+	if s.status != 200 || s.bytesReceived != 5 || s.bytesSent != int64(len(data)) {
+		t.Errorf("status %d, received %d, sent %d", s.status, s.bytesReceived, s.bytesSent)
+	}
+}
+
+func TestEmptyBodyIsNotChunked(t *testing.T) {
+	var encoding []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.TransferEncoding
+	}))
+	defer srv.Close()
+	req, err := parseHTTPFile(strings.NewReader("POST " + srv.URL + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := measureAttempt(req, *srv.Client(), nil, 1, options{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(encoding) != 0 {
+		t.Errorf("empty body sent with Transfer-Encoding %q", encoding)
+	}
+}
+
+// slowReader reads data a byte at a time, blocking for delay in each read.
+type slowReader struct {
+	data  []byte
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	n := copy(p[:1], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestTimedBodyAccountsTheSlowReads(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		// Answer after the client is done writing.
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer srv.Close()
+	const delay = 20 * time.Millisecond
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, nil)
+	req.ContentLength = 3
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(&slowReader{data: []byte("abc"), delay: delay}), nil
+	}
+	s, err := measureAttempt(req, *srv.Client(), nil, 1, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.bodyReadTook < 3*delay {
+		t.Errorf("body read took %s, want at least %s", s.bodyReadTook, 3*delay)
+	}
+	if s.bodyTook < s.bodyReadTook {
+		t.Errorf("body took %s, less than the %s reading it", s.bodyTook, s.bodyReadTook)
+	}
+}
+
+func TestTruncatedBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\npartial b")
+		buf.Flush()
+	}))
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	s, err := measureAttempt(req, *srv.Client(), nil, 1, options{})
+	if err == nil || !strings.Contains(err.Error(), "truncated response: got 9 of 1000 bytes") {
+		t.Fatalf("err = %v, want the response truncated after 9 bytes", err)
+	}
+	if !errors.Is(err, errTransfer) || exitCode(err) != exitTransfer {
+		t.Errorf("err = %v with exit code %d, want a transfer failure", err, exitCode(err))
+	}
+	if s.failedPhase != "Transfer" || s.bytesReceived != 9 {
+		t.Errorf("failed in %q after %d bytes", s.failedPhase, s.bytesReceived)
+	}
+}
+
+func TestBudgetCoversTheRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	for hop, next := range map[string]string{"/a": "/b", "/b": "/c", "/c": "/d"} {
+		mux.HandleFunc(hop, func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(40 * time.Millisecond)
+			http.Redirect(w, r, next, http.StatusFound)
+		})
+	}
+	mux.HandleFunc("/d", func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	client := *srv.Client()
+	client.CheckRedirect = checkRedirect
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/a", nil)
+	// Each hop fits in the budget, the chain does not.
+	s, err := measureAttempt(req, client, nil, 1, options{budget: 100 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "budget of 100ms exceeded") || exitCode(err) != exitTimeout {
+		t.Fatalf("err = %v, want the budget exceeded as a timeout", err)
+	}
+	if s.redirects < 1 {
+		t.Errorf("redirects = %d, want the budget spent after a redirect", s.redirects)
+	}
+}
+
+// zeroReader is an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestReadBodyStreams(t *testing.T) {
+	const size = 256 << 20
+	for _, tc := range []struct {
+		opts  options
+		bound uint64
+	}{
+		{options{}, 1 << 20},
+		{options{preview: 100}, 1 << 20},
+		{options{maxBytes: size / 2}, 1 << 20},
+		// -pretty keeps up to maxPrettyBytes of the body to indent it.
+		{options{preview: 100, pretty: true}, 16 * maxPrettyBytes},
+	} {
+		resp := &http.Response{
+			Header:        http.Header{"Content-Type": {"application/json"}},
+			ContentLength: -1,
+			Body:          io.NopCloser(io.LimitReader(zeroReader{}, size)),
+		}
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		if err := readBody(newStats(), resp, tc.opts); err != nil {
+			t.Fatal(err)
+		}
+		runtime.ReadMemStats(&after)
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > tc.bound {
+			t.Errorf("reading %d bytes with %+v allocated %d bytes, want at most %d", size, tc.opts, alloc, tc.bound)
+		}
+	}
+}
+
+func TestMaxBytesCutsLongerBodiesOnly(t *testing.T) {
+	const n = 16
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		if r.URL.Query().Has("length") {
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+		}
+		w.Write(bytes.Repeat([]byte("a"), size))
+		// Flushing before the handler returns, without a length, sends the
+		// body chunked.
+		http.NewResponseController(w).Flush()
+	}))
+	defer srv.Close()
+	for _, tc := range []struct {
+		query string
+		cut   bool
+	}{
+		{"size=16", false},
+		{"size=16&length", false},
+		{"size=15", false},
+		{"size=32", true},
+		{"size=32&length", true},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"?"+tc.query, nil)
+		s, err := measureAttempt(req, *srv.Client(), nil, 1, options{maxBytes: n})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.bodyCut != tc.cut || s.bytesReceived > n {
+			t.Errorf("%s: body cut %t after %d bytes, want cut %t", tc.query, s.bodyCut, s.bytesReceived, tc.cut)
+		}
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	for _, skew := range []time.Duration{time.Hour, -90 * time.Second} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Date", time.Now().Add(skew).UTC().Format(http.TimeFormat))
+		}))
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		s, err := measureAttempt(req, *srv.Client(), nil, 1, options{})
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Date is only accurate to the second.
+		if got := s.clockSkew(); got < skew-time.Second || got > skew+time.Second {
+			t.Errorf("clock skew %s, want %s", got, skew)
+		}
+	}
+	var b bytes.Buffer
+	s := measuredStats()
+	s.transferStartAt = s.totalStartAt.Add(5 * time.Millisecond)
+	s.serverDate = s.transferStartAt.Add(-time.Hour).Truncate(time.Second)
+	reportText(&b, s)
+	if want := "Server clock is 1h0m0s behind\n"; !strings.Contains(b.String(), want) {
+		t.Errorf("output lacks %q:\n%s", want, b.String())
+	}
+}
+
+func TestJSONFormatsCarryTheSameData(t *testing.T) {
+	var flat, nested bytes.Buffer
+	if err := reportJSON(&flat, measuredStats()); err != nil {
+		t.Fatal(err)
+	}
+	if err := reportNestedJSON(&nested, measuredStats()); err != nil {
+		t.Fatal(err)
+	}
+	var r result
+	if err := json.Unmarshal(flat.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	var n struct {
+		SchemaVersion int `json:"schema_version"`
+		Timings       struct {
+			DNS   float64 `json:"dns_ms"`
+			Total float64 `json:"total_ms"`
+		} `json:"timings"`
+		Response struct {
+			Reused bool `json:"reused"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(nested.Bytes(), &n); err != nil {
+		t.Fatal(err)
+	}
+	if n.SchemaVersion != r.SchemaVersion || n.Timings.DNS != r.DNS || n.Timings.Total != r.Total {
+		t.Errorf("nested %+v differs from flat %+v", n, r)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for key, want := range map[string]string{"env": "ENV", "Region-1": "REGION_1", "a.b c": "A_B_C", "ünï": "_N_"} {
+		if got := envName(key); got != want {
+			t.Errorf("envName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestEnvAndDevtoolsCarryTheRun(t *testing.T) {
+	checkReport(t, "env", measuredStats(), "HI_RUN=1\n", "HI_TIMESTAMP=2024-01-02T03:04:05Z\n", "HI_DNS_MS=2.000\n", "HI_TOTAL_MS=10.000\n", "HI_STATUS=200\n", "HI_LABEL_ENV='prod'\n")
+	checkReport(t, "devtools", measuredStats(), `"name":"Total"`, `"args":{"labels":{"env":"prod"},"run":1}`)
+}
+
+func TestStaleConnectionIsRetried(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+		// The second request finds the idle connection closed, as when the
+		// server times it out just as the request is sent.
+		if n == 2 {
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+	client := http.Client{Transport: &http.Transport{}}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if _, err := measureAttempt(req, client, nil, 1, options{}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := measureAttempt(req, client, nil, 2, options{})
+	if err != nil {
+		t.Fatalf("the request was not retried on a fresh connection: %v", err)
+	}
+	if s.staleTook <= 0 || s.status != http.StatusOK || s.failedPhase != "" {
+		t.Errorf("stale for %s, then answered %d with failed phase %q", s.staleTook, s.status, s.failedPhase)
+	}
+	if s.reused {
+		t.Error("the retry reports the stale connection as reused")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	addrs, _, err := lookup(fakeResolver(t, 0, net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")), "example.test.", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 {
+		t.Errorf("resolved %v, want an IPv4 and an IPv6 address", addrs)
+	}
+	for _, tc := range []struct {
+		rcode byte
+		want  string
+	}{
+		{3, "example.test. does not exist (NXDOMAIN)"},
+		{2, "nameserver failed to resolve example.test. (SERVFAIL)"},
+	} {
+		_, _, err := lookup(fakeResolver(t, tc.rcode), "example.test.", time.Second)
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("rcode %d: err = %v, want %q", tc.rcode, err, tc.want)
+		}
+	}
+}
+
+func TestDNSOnly(t *testing.T) {
+	stdout, stderr, code := runMain(t, "-dns-only", "-dns", fakeNameserver(t, 0, net.ParseIP("192.0.2.1")), "http://example.test./")
+	if code != 0 || !strings.HasPrefix(stdout, "DNS lookup of example.test. took ") || !strings.HasSuffix(stdout, "\n192.0.2.1\n") {
+		t.Errorf("exit code %d with output %q and errors %q", code, stdout, stderr)
+	}
+	_, stderr, code = runMain(t, "-dns-only", "-dns", fakeNameserver(t, 3), "http://example.test./")
+	if code != exitDNS || !strings.Contains(stderr, "example.test. does not exist (NXDOMAIN)") {
+		t.Errorf("NXDOMAIN: exit code %d with errors %q", code, stderr)
+	}
+}
+
+func TestHTTP10Request(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoAtLeast(1, 1) {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+		}
+	}))
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	data, err := http10Request(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := measureRaw(req.URL, data, &http.Transport{DialContext: (&net.Dialer{}).DialContext}, nil, 1, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.status != 200 || s.proto != "HTTP/1.0" {
+		t.Errorf("answered %d %s, want 200 HTTP/1.0", s.status, s.proto)
+	}
+}
+
+func TestRawRequestHonorsTheBudget(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	data := []byte("GET / HTTP/1.0\r\nHost: x\r\n\r\n")
+	_, err := measureRaw(u, data, &http.Transport{DialContext: (&net.Dialer{}).DialContext}, nil, 1, options{budget: 50 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "budget of 50ms exceeded") || exitCode(err) != exitTimeout {
+		t.Errorf("err = %v, want the budget exceeded as a timeout", err)
+	}
+}